@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/openshift/openshift-sdn/pkg/api"
+	"github.com/openshift/openshift-sdn/pkg/master"
+	"github.com/openshift/openshift-sdn/pkg/registry"
+)
+
+var (
+	registryKind  = flag.String("registry", "etcd", `SubnetRegistry backend to use: "etcd" or "bolt"`)
+	boltPath      = flag.String("bolt-path", "/var/lib/openshift-sdn/subnets.db", "bbolt database file (only used with --registry=bolt)")
+	etcdEndpoints = flag.String("etcd-endpoints", "http://127.0.0.1:2379", "comma-separated etcd endpoints (only used with --registry=etcd)")
+	force         = flag.Bool("force", false, "overwrite an existing registry when running snapshot restore")
+	network       = flag.String("container-network", "10.1.0.0/16", "overall container network CIDR to allocate minion subnets from")
+	subnetLength  = flag.Uint("subnet-length", 24, "size of the subnet allocated to each minion")
+)
+
+// newRegistry builds the SubnetRegistry backend selected by --registry.
+func newRegistry() (api.SubnetRegistry, error) {
+	switch *registryKind {
+	case "etcd":
+		return registry.NewEtcdSubnetRegistry(&registry.EtcdConfig{
+			Endpoints:        strings.Split(*etcdEndpoints, ","),
+			SubnetPath:       "/openshift.com/network/subnets",
+			SubnetConfigPath: "/openshift.com/network/config",
+			MinionPath:       "/openshift.com/network/minions",
+		})
+	case "bolt":
+		return registry.NewBoltSubnetRegistry(*boltPath)
+	default:
+		return nil, fmt.Errorf(`unknown --registry %q, must be "etcd" or "bolt"`, *registryKind)
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	reg, err := newRegistry()
+	if err != nil {
+		log.Fatalf("Failed to initialize %s registry: %v", *registryKind, err)
+	}
+
+	switch cmd := flag.Arg(0); cmd {
+	case "":
+		ctx := context.Background()
+		if err := reg.InitSubnets(ctx); err != nil {
+			log.Fatalf("InitSubnets: %v", err)
+		}
+		if err := reg.InitMinions(ctx); err != nil {
+			log.Fatalf("InitMinions: %v", err)
+		}
+		if err := master.StartMaster(ctx, reg, *network, *subnetLength); err != nil {
+			log.Fatalf("StartMaster: %v", err)
+		}
+	case "snapshot":
+		if err := runSnapshot(reg, flag.Args()[1:]); err != nil {
+			log.Fatalf("snapshot: %v", err)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown subcommand %q\n", cmd)
+		os.Exit(2)
+	}
+}
+
+// runSnapshot implements the "openshift-sdn snapshot save|restore <file>"
+// subcommand.
+func runSnapshot(reg api.SubnetRegistry, args []string) error {
+	if len(args) != 2 || (args[0] != "save" && args[0] != "restore") {
+		return fmt.Errorf("usage: openshift-sdn snapshot save|restore <file>")
+	}
+	action, file := args[0], args[1]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	switch action {
+	case "save":
+		f, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return reg.Snapshot(ctx, f)
+	default: // "restore"
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return reg.Restore(ctx, f, *force)
+	}
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// LeaseID identifies a registry-issued lease backing a minion registration
+// and, transitively, the subnet allocated to it. It is opaque to callers;
+// they only ever pass it back to KeepAliveMinion or to the subnet-writing
+// methods (CreateSubnet, CompareAndCreateSubnet, CompareAndSwapSubnet).
+type LeaseID int64
+
+// EventType describes what happened to a minion or subnet entry in the
+// registry: it was either added (any write of the entry, including an
+// update of one that already existed) or removed. Watches only report
+// changes made after they start; existing entries are not listed.
+type EventType int
+
+const (
+	Added EventType = iota
+	Deleted
+)
+
+// Subnet is the per-minion allocation handed out by the master: the CIDR
+// assigned to the node, plus whatever opaque data the node published about
+// itself when it registered.
+type Subnet struct {
+	Sub  string
+	Data string
+}
+
+// MinionEvent is emitted on the channel passed to SubnetRegistry.WatchMinions
+// whenever a minion is registered or its registration disappears.
+type MinionEvent struct {
+	Type   EventType
+	Minion string
+}
+
+// SubnetEvent is emitted on the channel passed to SubnetRegistry.WatchSubnets
+// whenever a subnet allocation is created or removed.
+type SubnetEvent struct {
+	Type   EventType
+	Minion string
+	Sub    Subnet
+}
+
+// SubnetRegistry is the storage backend for minion registrations and subnet
+// allocations. All methods take a context.Context so callers can bound
+// individual calls with a deadline and so long-running watches can be
+// cancelled for a clean shutdown.
+type SubnetRegistry interface {
+	CheckEtcdIsAlive(seconds uint64) bool
+
+	InitSubnets(ctx context.Context) error
+	InitMinions(ctx context.Context) error
+
+	GetMinions(ctx context.Context) (*[]string, error)
+	CreateMinion(ctx context.Context, minion string, data string) error
+
+	// RegisterMinion is the lease-backed counterpart to CreateMinion: the
+	// minion entry is only kept alive for ttl unless the caller renews it
+	// with KeepAliveMinion, so a node that stops responding is forgotten
+	// automatically instead of leaking its registration forever.
+	RegisterMinion(ctx context.Context, minion, data string, ttl time.Duration) (LeaseID, error)
+	KeepAliveMinion(ctx context.Context, lease LeaseID) error
+
+	GetSubnets(ctx context.Context) (*[]Subnet, error)
+	// GetSubnet returns minion's subnet along with the revision it was
+	// stored at, so a caller that wants to update it can hand that revision
+	// back to CompareAndSwapSubnet as prevIndex instead of racing a blind
+	// write against other writers.
+	GetSubnet(ctx context.Context, minion string) (*Subnet, uint64, error)
+	// CreateSubnet allocates subnet to minion. When lease is non-zero the
+	// subnet entry is attached to that lease (normally the one returned by
+	// RegisterMinion for the same minion) so it is reclaimed the moment the
+	// minion's registration expires.
+	CreateSubnet(ctx context.Context, minion string, subnet *Subnet, lease LeaseID) error
+	// CompareAndCreateSubnet is the race-safe alternative to CreateSubnet:
+	// it fails instead of overwriting when another writer already holds
+	// minion's subnet entry.
+	CompareAndCreateSubnet(ctx context.Context, minion string, subnet *Subnet, lease LeaseID) error
+	// CompareAndSwapSubnet updates an existing subnet entry only if it is
+	// still at prevIndex (as returned by a prior GetSubnet), failing with
+	// ErrCASFailed if another writer changed it first.
+	CompareAndSwapSubnet(ctx context.Context, minion string, subnet *Subnet, prevIndex uint64, lease LeaseID) error
+	DeleteSubnet(ctx context.Context, minion string) error
+
+	WriteNetworkConfig(ctx context.Context, network string, subnetLength uint) error
+	GetContainerNetwork(ctx context.Context) (string, error)
+	GetSubnetLength(ctx context.Context) (uint64, error)
+
+	WatchMinions(ctx context.Context, receiver chan *MinionEvent) error
+	WatchSubnets(ctx context.Context, receiver chan *SubnetEvent) error
+
+	// Snapshot writes a consistent point-in-time dump of the network
+	// config, minions and subnet allocations to w.
+	Snapshot(ctx context.Context, w io.Writer) error
+	// Restore repopulates the registry from a Snapshot dump. It refuses to
+	// run against a registry that already has subnet allocations unless
+	// force is set, in which case those allocations are wiped first.
+	Restore(ctx context.Context, r io.Reader, force bool) error
+}
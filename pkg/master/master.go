@@ -0,0 +1,57 @@
+package master
+
+import (
+	"context"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/openshift/openshift-sdn/pkg/api"
+	"github.com/openshift/openshift-sdn/pkg/registry"
+)
+
+// electionTTL is how long a master's leadership session is valid for
+// without renewal; clientv3 renews it automatically at electionTTL/3.
+const electionTTL = 15 * time.Second
+
+// StartMaster seeds the cluster's network configuration and then runs the
+// subnet allocator for as long as this process holds master leadership.
+// Only the etcd backend supports more than one master process, so running
+// against a bolt registry skips the election and just runs directly.
+func StartMaster(ctx context.Context, reg api.SubnetRegistry, network string, subnetLength uint) error {
+	if err := reg.WriteNetworkConfig(ctx, network, subnetLength); err != nil {
+		return err
+	}
+
+	etcdReg, ok := reg.(*registry.EtcdSubnetRegistry)
+	if !ok {
+		runAllocator(ctx, reg)
+		return nil
+	}
+
+	elector := etcdReg.NewLeaderElector(electionTTL)
+	return elector.RunAsLeader(ctx, func(leaderCtx context.Context) {
+		runAllocator(leaderCtx, reg)
+	})
+}
+
+// runAllocator watches for minion registrations for as long as ctx is
+// live and logs each minion event it receives; it does not itself
+// allocate subnets. It only ever runs on the current leader, so two
+// masters started for HA never watch concurrently.
+func runAllocator(ctx context.Context, reg api.SubnetRegistry) {
+	receiver := make(chan *api.MinionEvent)
+	go func() {
+		if err := reg.WatchMinions(ctx, receiver); err != nil && ctx.Err() == nil {
+			log.Errorf("WatchMinions exited: %v", err)
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-receiver:
+			log.Infof("Minion event: %v", ev)
+		}
+	}
+}
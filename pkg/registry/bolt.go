@@ -0,0 +1,486 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/openshift/openshift-sdn/pkg/api"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	subnetsBucket = []byte("subnets")
+	minionsBucket = []byte("minions")
+	configBucket  = []byte("config")
+)
+
+const (
+	networkConfigKey      = "ContainerNetwork"
+	subnetLengthConfigKey = "SubnetLength"
+)
+
+// subnetRecord is what actually gets stored for a subnet key: the
+// allocation itself plus a revision bumped on every write, so
+// CompareAndSwapSubnet has something to compare prevIndex against without
+// etcd's ModRevision to lean on.
+type subnetRecord struct {
+	Rev    uint64     `json:"rev"`
+	Subnet api.Subnet `json:"subnet"`
+}
+
+// BoltSubnetRegistry is an embedded, single-process SubnetRegistry backend
+// for operators who don't want to stand up a full etcd cluster just to run
+// one master. bbolt has no native watch support, so WatchMinions and
+// WatchSubnets are served from an in-process fan-out that every write pushes
+// events onto.
+type BoltSubnetRegistry struct {
+	db *bbolt.DB
+
+	mux            sync.Mutex
+	minionWatchers []chan *api.MinionEvent
+	subnetWatchers []chan *api.SubnetEvent
+}
+
+func NewBoltSubnetRegistry(path string) (api.SubnetRegistry, error) {
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, b := range [][]byte{subnetsBucket, minionsBucket, configBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltSubnetRegistry{db: db}, nil
+}
+
+func (r *BoltSubnetRegistry) CheckEtcdIsAlive(seconds uint64) bool {
+	return r.db != nil
+}
+
+func (r *BoltSubnetRegistry) InitSubnets(ctx context.Context) error { return nil }
+func (r *BoltSubnetRegistry) InitMinions(ctx context.Context) error { return nil }
+
+func (r *BoltSubnetRegistry) GetMinions(ctx context.Context) (*[]string, error) {
+	minions := make([]string, 0)
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(minionsBucket).ForEach(func(k, v []byte) error {
+			minions = append(minions, string(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &minions, nil
+}
+
+func (r *BoltSubnetRegistry) CreateMinion(ctx context.Context, minion string, data string) error {
+	created := false
+	err := r.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(minionsBucket)
+		if b.Get([]byte(minion)) != nil {
+			return nil
+		}
+		created = true
+		return b.Put([]byte(minion), []byte(data))
+	})
+	if err != nil {
+		return err
+	}
+	// Only notify when this call actually created the minion, matching the
+	// etcd backend's CreateMinion, which skips the write (and so the watch
+	// event) when the minion key already exists.
+	if created {
+		r.notifyMinion(&api.MinionEvent{Type: api.Added, Minion: minion})
+	}
+	return nil
+}
+
+// RegisterMinion has no lease to attach under bbolt: a single-master
+// deployment has no one else to race with, so the registration simply
+// lives until the minion or an operator removes it. ttl is accepted only
+// to satisfy the SubnetRegistry interface.
+func (r *BoltSubnetRegistry) RegisterMinion(ctx context.Context, minion, data string, ttl time.Duration) (api.LeaseID, error) {
+	return 0, r.CreateMinion(ctx, minion, data)
+}
+
+func (r *BoltSubnetRegistry) KeepAliveMinion(ctx context.Context, lease api.LeaseID) error {
+	return nil
+}
+
+func (r *BoltSubnetRegistry) GetSubnets(ctx context.Context) (*[]api.Subnet, error) {
+	subnets := make([]api.Subnet, 0)
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(subnetsBucket).ForEach(func(k, v []byte) error {
+			var rec subnetRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				log.Errorf("Error unmarshalling subnet record for minion %s: %v", k, err)
+				return nil
+			}
+			subnets = append(subnets, rec.Subnet)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &subnets, nil
+}
+
+func (r *BoltSubnetRegistry) GetSubnet(ctx context.Context, minion string) (*api.Subnet, uint64, error) {
+	var rec subnetRecord
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(subnetsBucket).Get([]byte(minion))
+		if v == nil {
+			return ErrSubnetNotFound
+		}
+		return json.Unmarshal(v, &rec)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return &rec.Subnet, rec.Rev, nil
+}
+
+func (r *BoltSubnetRegistry) DeleteSubnet(ctx context.Context, minion string) error {
+	deleted := false
+	err := r.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(subnetsBucket)
+		if b.Get([]byte(minion)) == nil {
+			return nil
+		}
+		deleted = true
+		return b.Delete([]byte(minion))
+	})
+	if err != nil {
+		return err
+	}
+	// Only notify when a subnet actually existed to delete, matching the
+	// etcd backend's no-event-on-no-op semantics.
+	if deleted {
+		r.notifySubnet(&api.SubnetEvent{Type: api.Deleted, Minion: minion})
+	}
+	return nil
+}
+
+func (r *BoltSubnetRegistry) CreateSubnet(ctx context.Context, minion string, subnet *api.Subnet, lease api.LeaseID) error {
+	err := r.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(subnetsBucket)
+		rev := uint64(1)
+		if v := b.Get([]byte(minion)); v != nil {
+			var existing subnetRecord
+			if err := json.Unmarshal(v, &existing); err == nil {
+				rev = existing.Rev + 1
+			}
+		}
+		data, err := json.Marshal(subnetRecord{Rev: rev, Subnet: *subnet})
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(minion), data)
+	})
+	if err != nil {
+		return err
+	}
+	r.notifySubnet(&api.SubnetEvent{Type: api.Added, Minion: minion, Sub: *subnet})
+	return nil
+}
+
+func (r *BoltSubnetRegistry) CompareAndCreateSubnet(ctx context.Context, minion string, subnet *api.Subnet, lease api.LeaseID) error {
+	err := r.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(subnetsBucket)
+		if b.Get([]byte(minion)) != nil {
+			return ErrKeyExists
+		}
+		data, err := json.Marshal(subnetRecord{Rev: 1, Subnet: *subnet})
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(minion), data)
+	})
+	if err != nil {
+		return err
+	}
+	r.notifySubnet(&api.SubnetEvent{Type: api.Added, Minion: minion, Sub: *subnet})
+	return nil
+}
+
+func (r *BoltSubnetRegistry) CompareAndSwapSubnet(ctx context.Context, minion string, subnet *api.Subnet, prevIndex uint64, lease api.LeaseID) error {
+	err := r.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(subnetsBucket)
+		v := b.Get([]byte(minion))
+		if v == nil {
+			return ErrSubnetNotFound
+		}
+		var existing subnetRecord
+		if err := json.Unmarshal(v, &existing); err != nil {
+			return err
+		}
+		if existing.Rev != prevIndex {
+			return ErrCASFailed
+		}
+		data, err := json.Marshal(subnetRecord{Rev: existing.Rev + 1, Subnet: *subnet})
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(minion), data)
+	})
+	if err != nil {
+		return err
+	}
+	r.notifySubnet(&api.SubnetEvent{Type: api.Added, Minion: minion, Sub: *subnet})
+	return nil
+}
+
+func (r *BoltSubnetRegistry) WriteNetworkConfig(ctx context.Context, network string, subnetLength uint) error {
+	return r.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(configBucket)
+		if existing := b.Get([]byte(networkConfigKey)); existing != nil {
+			if string(existing) != network {
+				return ErrNetworkMismatch
+			}
+		} else if err := b.Put([]byte(networkConfigKey), []byte(network)); err != nil {
+			return err
+		}
+
+		data := []byte(strconv.FormatUint(uint64(subnetLength), 10))
+		if b.Get([]byte(subnetLengthConfigKey)) != nil {
+			return nil
+		}
+		return b.Put([]byte(subnetLengthConfigKey), data)
+	})
+}
+
+func (r *BoltSubnetRegistry) GetContainerNetwork(ctx context.Context) (string, error) {
+	var network string
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(configBucket).Get([]byte(networkConfigKey))
+		if v == nil {
+			return ErrNoNetworkConfig
+		}
+		network = string(v)
+		return nil
+	})
+	return network, err
+}
+
+func (r *BoltSubnetRegistry) GetSubnetLength(ctx context.Context) (uint64, error) {
+	var length uint64
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(configBucket).Get([]byte(subnetLengthConfigKey))
+		if v == nil {
+			return ErrNoNetworkConfig
+		}
+		var err error
+		length, err = strconv.ParseUint(string(v), 10, 0)
+		return err
+	})
+	return length, err
+}
+
+func (r *BoltSubnetRegistry) WatchMinions(ctx context.Context, receiver chan *api.MinionEvent) error {
+	ch := make(chan *api.MinionEvent, 16)
+	r.mux.Lock()
+	r.minionWatchers = append(r.minionWatchers, ch)
+	r.mux.Unlock()
+	defer r.removeMinionWatcher(ch)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev := <-ch:
+			receiver <- ev
+		}
+	}
+}
+
+func (r *BoltSubnetRegistry) WatchSubnets(ctx context.Context, receiver chan *api.SubnetEvent) error {
+	ch := make(chan *api.SubnetEvent, 16)
+	r.mux.Lock()
+	r.subnetWatchers = append(r.subnetWatchers, ch)
+	r.mux.Unlock()
+	defer r.removeSubnetWatcher(ch)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev := <-ch:
+			receiver <- ev
+		}
+	}
+}
+
+func (r *BoltSubnetRegistry) notifyMinion(ev *api.MinionEvent) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, ch := range r.minionWatchers {
+		select {
+		case ch <- ev:
+		default:
+			log.Warningf("Dropping minion event for a slow watcher: %v", ev)
+		}
+	}
+}
+
+func (r *BoltSubnetRegistry) notifySubnet(ev *api.SubnetEvent) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, ch := range r.subnetWatchers {
+		select {
+		case ch <- ev:
+		default:
+			log.Warningf("Dropping subnet event for a slow watcher: %v", ev)
+		}
+	}
+}
+
+func (r *BoltSubnetRegistry) removeMinionWatcher(ch chan *api.MinionEvent) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for i, c := range r.minionWatchers {
+		if c == ch {
+			r.minionWatchers = append(r.minionWatchers[:i], r.minionWatchers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (r *BoltSubnetRegistry) Snapshot(ctx context.Context, w io.Writer) error {
+	var snap snapshotDoc
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		network := tx.Bucket(configBucket).Get([]byte(networkConfigKey))
+		if network == nil {
+			return ErrNoNetworkConfig
+		}
+		snap.Network = string(network)
+
+		if length := tx.Bucket(configBucket).Get([]byte(subnetLengthConfigKey)); length != nil {
+			parsed, err := strconv.ParseUint(string(length), 10, 0)
+			if err != nil {
+				return err
+			}
+			snap.SubnetLength = parsed
+		}
+
+		snap.Minions = make([]string, 0)
+		if err := tx.Bucket(minionsBucket).ForEach(func(k, v []byte) error {
+			snap.Minions = append(snap.Minions, string(k))
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		snap.Subnets = make(map[string]api.Subnet)
+		return tx.Bucket(subnetsBucket).ForEach(func(k, v []byte) error {
+			var rec subnetRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				log.Errorf("Error unmarshalling subnet record for minion %s while snapshotting: %v", k, err)
+				return nil
+			}
+			snap.Subnets[string(k)] = rec.Subnet
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(&snap)
+}
+
+func (r *BoltSubnetRegistry) Restore(ctx context.Context, rd io.Reader, force bool) error {
+	var snap snapshotDoc
+	if err := json.NewDecoder(rd).Decode(&snap); err != nil {
+		return err
+	}
+
+	err := r.db.Update(func(tx *bbolt.Tx) error {
+		subnets := tx.Bucket(subnetsBucket)
+		if stats := subnets.Stats(); stats.KeyN > 0 {
+			if !force {
+				return fmt.Errorf("refusing to restore over %d existing subnet(s); pass force to overwrite", stats.KeyN)
+			}
+			if err := tx.DeleteBucket(subnetsBucket); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(subnetsBucket); err != nil {
+				return err
+			}
+			if err := tx.DeleteBucket(configBucket); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(configBucket); err != nil {
+				return err
+			}
+		}
+
+		config := tx.Bucket(configBucket)
+		if err := config.Put([]byte(networkConfigKey), []byte(snap.Network)); err != nil {
+			return err
+		}
+		if err := config.Put([]byte(subnetLengthConfigKey), []byte(strconv.FormatUint(snap.SubnetLength, 10))); err != nil {
+			return err
+		}
+
+		minions := tx.Bucket(minionsBucket)
+		for _, minion := range snap.Minions {
+			if minions.Get([]byte(minion)) == nil {
+				if err := minions.Put([]byte(minion), []byte("")); err != nil {
+					return err
+				}
+			}
+		}
+
+		subnets = tx.Bucket(subnetsBucket)
+		for minion, sub := range snap.Subnets {
+			data, err := json.Marshal(subnetRecord{Rev: 1, Subnet: sub})
+			if err != nil {
+				return err
+			}
+			if err := subnets.Put([]byte(minion), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, minion := range snap.Minions {
+		r.notifyMinion(&api.MinionEvent{Type: api.Added, Minion: minion})
+	}
+	for minion, sub := range snap.Subnets {
+		subnet := sub
+		r.notifySubnet(&api.SubnetEvent{Type: api.Added, Minion: minion, Sub: subnet})
+	}
+	return nil
+}
+
+func (r *BoltSubnetRegistry) removeSubnetWatcher(ch chan *api.SubnetEvent) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for i, c := range r.subnetWatchers {
+		if c == ch {
+			r.subnetWatchers = append(r.subnetWatchers[:i], r.subnetWatchers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/openshift/openshift-sdn/pkg/api"
+)
+
+func newTestBoltRegistry(t *testing.T) *BoltSubnetRegistry {
+	t.Helper()
+	reg, err := NewBoltSubnetRegistry(filepath.Join(t.TempDir(), "subnets.db"))
+	if err != nil {
+		t.Fatalf("NewBoltSubnetRegistry: %v", err)
+	}
+	return reg.(*BoltSubnetRegistry)
+}
+
+func TestBoltCreateAndGetSubnet(t *testing.T) {
+	reg := newTestBoltRegistry(t)
+	ctx := context.Background()
+
+	want := &api.Subnet{Sub: "10.1.1.0/24", Data: "minion1-data"}
+	if err := reg.CreateSubnet(ctx, "minion1", want, 0); err != nil {
+		t.Fatalf("CreateSubnet: %v", err)
+	}
+
+	got, _, err := reg.GetSubnet(ctx, "minion1")
+	if err != nil {
+		t.Fatalf("GetSubnet: %v", err)
+	}
+	if *got != *want {
+		t.Fatalf("GetSubnet = %+v, want %+v", got, want)
+	}
+
+	if _, _, err := reg.GetSubnet(ctx, "missing"); !errors.Is(err, ErrSubnetNotFound) {
+		t.Fatalf("GetSubnet(missing) err = %v, want ErrSubnetNotFound", err)
+	}
+}
+
+func TestBoltCompareAndCreateSubnetFailsOnExisting(t *testing.T) {
+	reg := newTestBoltRegistry(t)
+	ctx := context.Background()
+	sub := &api.Subnet{Sub: "10.1.1.0/24"}
+
+	if err := reg.CompareAndCreateSubnet(ctx, "minion1", sub, 0); err != nil {
+		t.Fatalf("first CompareAndCreateSubnet: %v", err)
+	}
+	if err := reg.CompareAndCreateSubnet(ctx, "minion1", sub, 0); !errors.Is(err, ErrKeyExists) {
+		t.Fatalf("second CompareAndCreateSubnet err = %v, want ErrKeyExists", err)
+	}
+}
+
+func TestBoltCompareAndSwapSubnet(t *testing.T) {
+	reg := newTestBoltRegistry(t)
+	ctx := context.Background()
+
+	if err := reg.CreateSubnet(ctx, "minion1", &api.Subnet{Sub: "10.1.1.0/24"}, 0); err != nil {
+		t.Fatalf("CreateSubnet: %v", err)
+	}
+	_, rev, err := reg.GetSubnet(ctx, "minion1")
+	if err != nil {
+		t.Fatalf("GetSubnet: %v", err)
+	}
+
+	updated := &api.Subnet{Sub: "10.1.1.0/24", Data: "updated"}
+	if err := reg.CompareAndSwapSubnet(ctx, "minion1", updated, rev, 0); err != nil {
+		t.Fatalf("CompareAndSwapSubnet at current rev: %v", err)
+	}
+
+	// rev is now stale; swapping against it again must fail.
+	if err := reg.CompareAndSwapSubnet(ctx, "minion1", updated, rev, 0); !errors.Is(err, ErrCASFailed) {
+		t.Fatalf("CompareAndSwapSubnet at stale rev err = %v, want ErrCASFailed", err)
+	}
+
+	got, _, err := reg.GetSubnet(ctx, "minion1")
+	if err != nil {
+		t.Fatalf("GetSubnet: %v", err)
+	}
+	if got.Data != "updated" {
+		t.Fatalf("GetSubnet.Data = %q, want %q", got.Data, "updated")
+	}
+}
+
+func TestBoltWriteNetworkConfigMismatch(t *testing.T) {
+	reg := newTestBoltRegistry(t)
+	ctx := context.Background()
+
+	if err := reg.WriteNetworkConfig(ctx, "10.1.0.0/16", 24); err != nil {
+		t.Fatalf("first WriteNetworkConfig: %v", err)
+	}
+	if err := reg.WriteNetworkConfig(ctx, "10.1.0.0/16", 24); err != nil {
+		t.Fatalf("repeat WriteNetworkConfig with same network: %v", err)
+	}
+	if err := reg.WriteNetworkConfig(ctx, "10.2.0.0/16", 24); !errors.Is(err, ErrNetworkMismatch) {
+		t.Fatalf("WriteNetworkConfig with different network err = %v, want ErrNetworkMismatch", err)
+	}
+}
+
+func TestBoltWatchSubnetsFanOut(t *testing.T) {
+	reg := newTestBoltRegistry(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	receiver := make(chan *api.SubnetEvent, 1)
+	go reg.WatchSubnets(ctx, receiver)
+
+	// Give WatchSubnets time to register its channel before the write.
+	time.Sleep(10 * time.Millisecond)
+
+	sub := &api.Subnet{Sub: "10.1.1.0/24"}
+	if err := reg.CreateSubnet(ctx, "minion1", sub, 0); err != nil {
+		t.Fatalf("CreateSubnet: %v", err)
+	}
+
+	select {
+	case ev := <-receiver:
+		if ev.Type != api.Added || ev.Minion != "minion1" || ev.Sub != *sub {
+			t.Fatalf("unexpected subnet event: %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for subnet event")
+	}
+
+	if err := reg.DeleteSubnet(ctx, "minion1"); err != nil {
+		t.Fatalf("DeleteSubnet: %v", err)
+	}
+	select {
+	case ev := <-receiver:
+		if ev.Type != api.Deleted || ev.Minion != "minion1" {
+			t.Fatalf("unexpected subnet event: %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for delete event")
+	}
+}
+
+func TestBoltSnapshotRestoreRoundTrip(t *testing.T) {
+	src := newTestBoltRegistry(t)
+	ctx := context.Background()
+
+	if err := src.WriteNetworkConfig(ctx, "10.1.0.0/16", 24); err != nil {
+		t.Fatalf("WriteNetworkConfig: %v", err)
+	}
+	if err := src.CreateMinion(ctx, "minion1", ""); err != nil {
+		t.Fatalf("CreateMinion: %v", err)
+	}
+	if err := src.CreateSubnet(ctx, "minion1", &api.Subnet{Sub: "10.1.1.0/24"}, 0); err != nil {
+		t.Fatalf("CreateSubnet: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.Snapshot(ctx, &buf); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	dst := newTestBoltRegistry(t)
+	if err := dst.Restore(ctx, bytes.NewReader(buf.Bytes()), false); err != nil {
+		t.Fatalf("Restore into empty registry: %v", err)
+	}
+
+	network, err := dst.GetContainerNetwork(ctx)
+	if err != nil || network != "10.1.0.0/16" {
+		t.Fatalf("GetContainerNetwork = (%q, %v), want 10.1.0.0/16", network, err)
+	}
+	sub, _, err := dst.GetSubnet(ctx, "minion1")
+	if err != nil || sub.Sub != "10.1.1.0/24" {
+		t.Fatalf("GetSubnet = (%+v, %v), want 10.1.1.0/24", sub, err)
+	}
+
+	// A second restore without force must refuse to touch the existing data.
+	if err := dst.Restore(ctx, bytes.NewReader(buf.Bytes()), false); err == nil {
+		t.Fatal("Restore without force over non-empty registry should have failed")
+	}
+
+	// With force it should succeed and leave the data intact.
+	if err := dst.Restore(ctx, bytes.NewReader(buf.Bytes()), true); err != nil {
+		t.Fatalf("Restore with force: %v", err)
+	}
+	if sub, _, err := dst.GetSubnet(ctx, "minion1"); err != nil || sub.Sub != "10.1.1.0/24" {
+		t.Fatalf("GetSubnet after forced restore = (%+v, %v), want 10.1.1.0/24", sub, err)
+	}
+}
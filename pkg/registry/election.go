@@ -0,0 +1,111 @@
+package registry
+
+import (
+	"context"
+	"path"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/clientv3/concurrency"
+)
+
+var leaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: "openshift_sdn",
+	Subsystem: "master",
+	Name:      "is_leader",
+	Help:      "1 if this master process currently holds the subnet allocator leader lease, 0 otherwise.",
+})
+
+func init() {
+	prometheus.MustRegister(leaderGauge)
+}
+
+// LeaderElector coordinates multiple openshift-sdn master processes so that
+// only one of them ever runs the subnet allocator (WatchMinions plus the
+// CIDR allocation loop) at a time; standbys block until the leader's
+// session lease expires and then take over.
+type LeaderElector struct {
+	cli  *clientv3.Client
+	path string
+	ttl  int
+}
+
+// NewLeaderElector builds a LeaderElector that campaigns under
+// <etcdCfg.SubnetConfigPath>/master, backed by a session whose lease has the
+// given ttl (clientv3 renews it at ttl/3).
+func NewLeaderElector(cli *clientv3.Client, etcdCfg *EtcdConfig, ttl time.Duration) *LeaderElector {
+	return &LeaderElector{
+		cli:  cli,
+		path: path.Join(etcdCfg.SubnetConfigPath, "master"),
+		ttl:  int(ttl.Seconds()),
+	}
+}
+
+// RunAsLeader campaigns for leadership at e.path and, once acquired, calls
+// fn with a context that is cancelled the moment this process loses the
+// election (so fn can tear down its allocator loops promptly). Losing
+// leadership (the session expiring or being closed out from under it) does
+// not end RunAsLeader: it re-campaigns and calls fn again, so a standby
+// that wins a later election still gets to run. RunAsLeader only returns
+// once ctx itself is cancelled, or campaigning fails for a reason unrelated
+// to ctx (e.g. the etcd client is misconfigured), in which case that error
+// is returned so the caller can decide whether to retry or exit.
+func (e *LeaderElector) RunAsLeader(ctx context.Context, fn func(ctx context.Context)) error {
+	for {
+		if err := e.runOnce(ctx, fn); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Infof("Re-campaigning for master leadership at %s", e.path)
+	}
+}
+
+// runOnce campaigns once, runs fn for as long as leadership is held, and
+// returns nil when leadership is lost (or never acquired because ctx was
+// cancelled mid-campaign) so the caller re-campaigns. It only returns a
+// non-nil error for failures unrelated to ctx cancellation or leadership
+// loss, such as a session that could not be established at all.
+func (e *LeaderElector) runOnce(ctx context.Context, fn func(ctx context.Context)) error {
+	session, err := concurrency.NewSession(e.cli, concurrency.WithTTL(e.ttl), concurrency.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer session.Close()
+
+	election := concurrency.NewElection(session, e.path)
+
+	log.Infof("Campaigning for master leadership at %s", e.path)
+	if err := election.Campaign(ctx, ""); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	leaderGauge.Set(1)
+	log.Infof("Acquired master leadership at %s", e.path)
+	defer func() {
+		leaderGauge.Set(0)
+		log.Infof("Lost master leadership at %s", e.path)
+	}()
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-session.Done():
+			cancel()
+		case <-leaderCtx.Done():
+		}
+	}()
+
+	fn(leaderCtx)
+	return nil
+}
@@ -0,0 +1,42 @@
+package registry
+
+import (
+	"context"
+	"errors"
+
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+)
+
+// Sentinel errors returned by every SubnetRegistry implementation (etcd and
+// bolt alike). Callers should use errors.Is against these instead of
+// matching on a backend's own error strings, so "the subnet doesn't exist
+// yet" can be told apart from "etcd is down", and the same errors.Is check
+// works regardless of which backend is configured.
+var (
+	ErrSubnetNotFound     = errors.New("subnet not found")
+	ErrMinionNotFound     = errors.New("minion not found")
+	ErrKeyExists          = errors.New("key already exists")
+	ErrCASFailed          = errors.New("compare-and-swap failed: stored value changed")
+	ErrNoNetworkConfig    = errors.New("no network configuration found")
+	ErrNetworkMismatch    = errors.New("cluster is already configured with a different network")
+	ErrClusterUnavailable = errors.New("etcd cluster unavailable")
+)
+
+// classifyErr translates a raw error coming back from the etcd client into
+// ErrClusterUnavailable when it reflects the cluster being unreachable, and
+// passes everything else through unchanged. "Not found" is never signalled
+// this way under clientv3 - a Get simply returns zero Kvs - so callers
+// translate that case themselves into the sentinel that fits the key they
+// were looking up (ErrSubnetNotFound, ErrNoNetworkConfig).
+func classifyErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch err {
+	case rpctypes.ErrUnhealthy, rpctypes.ErrNoLeader, rpctypes.ErrLeaderChanged, rpctypes.ErrTimeout:
+		return ErrClusterUnavailable
+	case context.DeadlineExceeded, context.Canceled:
+		return ErrClusterUnavailable
+	}
+	return err
+}
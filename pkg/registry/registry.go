@@ -1,17 +1,20 @@
 package registry
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"path"
 	"strconv"
-	"sync"
 	"time"
 
-	"github.com/coreos/go-etcd/etcd"
 	log "github.com/golang/glog"
 	"github.com/openshift/openshift-sdn/pkg/api"
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+	"go.etcd.io/etcd/pkg/transport"
 )
 
 type EtcdConfig struct {
@@ -25,75 +28,87 @@ type EtcdConfig struct {
 }
 
 type EtcdSubnetRegistry struct {
-	mux     sync.Mutex
-	cli     *etcd.Client
+	cli     *clientv3.Client
 	etcdCfg *EtcdConfig
 }
 
-func newMinionEvent(action, key, value string) *api.MinionEvent {
-	min := &api.MinionEvent{}
-	switch action {
-	case "delete", "deleted", "expired":
-		min.Type = api.Deleted
-	default:
-		min.Type = api.Added
+func newMinionEvent(ev *clientv3.Event) *api.MinionEvent {
+	evType := api.Added
+	if ev.Type == mvccpb.DELETE {
+		evType = api.Deleted
 	}
-
-	if key != "" {
-		_, min.Minion = path.Split(key)
-		return min
-	}
-
-	fmt.Printf("Error decoding minion event: nil key (%s,%s,%s).\n", action, key, value)
-	return nil
+	_, minion := path.Split(string(ev.Kv.Key))
+	return &api.MinionEvent{Type: evType, Minion: minion}
 }
 
-func newSubnetEvent(resp *etcd.Response) *api.SubnetEvent {
-	var value string
-	_, minkey := path.Split(resp.Node.Key)
-	var t api.EventType
-	switch resp.Action {
-	case "deleted", "delete", "expired":
-		t = api.Deleted
-		value = resp.PrevNode.Value
-	default:
-		t = api.Added
-		value = resp.Node.Value
+func newSubnetEvent(ev *clientv3.Event) *api.SubnetEvent {
+	evType := api.Added
+	kv := ev.Kv
+	if ev.Type == mvccpb.DELETE {
+		evType = api.Deleted
+		kv = ev.PrevKv
+	}
+	if kv == nil {
+		log.Errorf("Failed to process subnet event: no key/value on event %v", ev)
+		return nil
 	}
+	_, minion := path.Split(string(kv.Key))
 	var sub api.Subnet
-	if err := json.Unmarshal([]byte(value), &sub); err == nil {
-		return &api.SubnetEvent{
-			Type:   t,
-			Minion: minkey,
-			Sub:    sub,
-		}
+	if err := json.Unmarshal(kv.Value, &sub); err != nil {
+		log.Errorf("Failed to unmarshal subnet event value for %s: %v", minion, err)
+		return nil
 	}
-	log.Errorf("Failed to unmarshal response: %v", resp)
-	return nil
+	return &api.SubnetEvent{Type: evType, Minion: minion, Sub: sub}
 }
 
-func newEtcdClient(c *EtcdConfig) (*etcd.Client, error) {
+func newEtcdClient(c *EtcdConfig) (*clientv3.Client, error) {
+	cfg := clientv3.Config{
+		Endpoints:   c.Endpoints,
+		DialTimeout: 5 * time.Second,
+	}
+
 	if c.Keyfile != "" || c.Certfile != "" || c.CAFile != "" {
-		return etcd.NewTLSClient(c.Endpoints, c.Certfile, c.Keyfile, c.CAFile)
-	} else {
-		return etcd.NewClient(c.Endpoints), nil
+		tlsInfo := transport.TLSInfo{
+			CertFile: c.Certfile,
+			KeyFile:  c.Keyfile,
+			CAFile:   c.CAFile,
+		}
+		tlsConfig, err := tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		cfg.TLS = tlsConfig
 	}
+
+	return clientv3.New(cfg)
 }
 
+// CheckEtcdIsAlive blocks, retrying every 5 seconds, until the etcd cluster
+// answers or the given number of seconds elapses.
 func (sub *EtcdSubnetRegistry) CheckEtcdIsAlive(seconds uint64) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(seconds)*time.Second)
+	defer cancel()
+
 	for {
-		status := sub.client().SyncCluster()
-		log.Infof("Etcd cluster status: %v", status)
-		if status {
-			return status
+		err := sub.cli.Sync(ctx)
+		log.Infof("Etcd cluster status: %v", err)
+		if err == nil {
+			return true
 		}
-		if seconds <= 0 {
-			break
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(5 * time.Second):
 		}
-		time.Sleep(5 * time.Second)
-		seconds -= 5
 	}
-	return false
+}
+
+// NewLeaderElector returns a LeaderElector that campaigns for master
+// leadership using this registry's etcd client and configuration, so
+// StartMaster can run the allocator loops only while RunAsLeader reports
+// this process as leader.
+func (sub *EtcdSubnetRegistry) NewLeaderElector(ttl time.Duration) *LeaderElector {
+	return NewLeaderElector(sub.cli, sub.etcdCfg, ttl)
 }
 
 func NewEtcdSubnetRegistry(config *EtcdConfig) (api.SubnetRegistry, error) {
@@ -110,245 +125,463 @@ func NewEtcdSubnetRegistry(config *EtcdConfig) (api.SubnetRegistry, error) {
 	return r, nil
 }
 
-func (sub *EtcdSubnetRegistry) InitSubnets() error {
-	key := sub.etcdCfg.SubnetPath
-	_, err := sub.client().SetDir(key, 0)
-	if err != nil {
-		return err
-	}
-	key = sub.etcdCfg.SubnetConfigPath
-	_, err = sub.client().SetDir(key, 0)
-	return err
+// InitSubnets and InitMinions are no-ops under clientv3: etcd v3's keyspace
+// is flat, so the "directories" the v2 client used to create up front are
+// just key prefixes that come into existence the first time a key is
+// written under them.
+func (sub *EtcdSubnetRegistry) InitSubnets(ctx context.Context) error {
+	return nil
 }
 
-func (sub *EtcdSubnetRegistry) InitMinions() error {
-	key := sub.etcdCfg.MinionPath
-	_, err := sub.client().SetDir(key, 0)
-	return err
+func (sub *EtcdSubnetRegistry) InitMinions(ctx context.Context) error {
+	return nil
 }
 
-func (sub *EtcdSubnetRegistry) GetMinions() (*[]string, error) {
+func (sub *EtcdSubnetRegistry) GetMinions(ctx context.Context) (*[]string, error) {
 	key := sub.etcdCfg.MinionPath
-	resp, err := sub.client().Get(key, false, true)
+	resp, err := sub.cli.Get(ctx, key, clientv3.WithPrefix())
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.Node.Dir == false {
-		return nil, errors.New("Minion path is not a directory")
-	}
-
-	minions := make([]string, 0)
-
-	for _, node := range resp.Node.Nodes {
-		if node.Key == "" {
-			log.Errorf("Error unmarshalling GetMinions response node %s", node.Key)
-			continue
-		}
-		_, minion := path.Split(node.Key)
+	minions := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		_, minion := path.Split(string(kv.Key))
 		minions = append(minions, minion)
 	}
 	return &minions, nil
 }
 
-func (sub *EtcdSubnetRegistry) GetSubnets() (*[]api.Subnet, error) {
+func (sub *EtcdSubnetRegistry) GetSubnets(ctx context.Context) (*[]api.Subnet, error) {
 	key := sub.etcdCfg.SubnetPath
-	resp, err := sub.client().Get(key, false, true)
+	resp, err := sub.cli.Get(ctx, key, clientv3.WithPrefix())
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.Node.Dir == false {
-		return nil, errors.New("Subnet path is not a directory")
-	}
-
-	subnets := make([]api.Subnet, 0)
-
-	for _, node := range resp.Node.Nodes {
+	subnets := make([]api.Subnet, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
 		var s api.Subnet
-		err := json.Unmarshal([]byte(node.Value), &s)
-		if err != nil {
-			log.Errorf("Error unmarshalling GetSubnets response for node %s: %s", node.Value, err.Error())
+		if err := json.Unmarshal(kv.Value, &s); err != nil {
+			log.Errorf("Error unmarshalling GetSubnets response for key %s: %v", kv.Key, err)
 			continue
 		}
 		subnets = append(subnets, s)
 	}
-	return &subnets, err
+	return &subnets, nil
 }
 
-func (sub *EtcdSubnetRegistry) GetSubnet(minionip string) (*api.Subnet, error) {
-	key := path.Join(sub.etcdCfg.SubnetPath, minionip)
-	resp, err := sub.client().Get(key, false, false)
-	if err == nil {
-		log.Infof("Unmarshalling response: %s", resp.Node.Value)
-		var sub api.Subnet
-		if err = json.Unmarshal([]byte(resp.Node.Value), &sub); err == nil {
-			return &sub, nil
-		}
-		return nil, err
+func (sub *EtcdSubnetRegistry) GetSubnet(ctx context.Context, minion string) (*api.Subnet, uint64, error) {
+	key := path.Join(sub.etcdCfg.SubnetPath, minion)
+	resp, err := sub.cli.Get(ctx, key)
+	if err != nil {
+		return nil, 0, classifyErr(err)
 	}
-	return nil, err
+	if len(resp.Kvs) == 0 {
+		return nil, 0, ErrSubnetNotFound
+	}
+
+	var s api.Subnet
+	if err := json.Unmarshal(resp.Kvs[0].Value, &s); err != nil {
+		return nil, 0, err
+	}
+	return &s, uint64(resp.Kvs[0].ModRevision), nil
 }
 
-func (sub *EtcdSubnetRegistry) DeleteSubnet(minion string) error {
+func (sub *EtcdSubnetRegistry) DeleteSubnet(ctx context.Context, minion string) error {
 	key := path.Join(sub.etcdCfg.SubnetPath, minion)
-	_, err := sub.client().Delete(key, false)
+	_, err := sub.cli.Delete(ctx, key)
 	return err
 }
 
-func (sub *EtcdSubnetRegistry) WriteNetworkConfig(network string, subnetLength uint) error {
+// WriteNetworkConfig writes the cluster's network and subnet length exactly
+// once, using a compare-and-swap so that re-running the master against an
+// already-configured cluster fails loudly on a mismatch instead of silently
+// overwriting the CIDR every other node has already allocated against.
+func (sub *EtcdSubnetRegistry) WriteNetworkConfig(ctx context.Context, network string, subnetLength uint) error {
 	key := path.Join(sub.etcdCfg.SubnetConfigPath, "ContainerNetwork")
-	_, err := sub.client().Create(key, network, 0)
+	resp, err := sub.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, network)).
+		Commit()
 	if err != nil {
-		log.Warningf("Found existing network configuration, overwriting it.")
-		_, err = sub.client().Update(key, network, 0)
+		log.Errorf("Failed to write Network configuration to etcd: %v", err)
+		return err
+	}
+	if !resp.Succeeded {
+		existing, err := sub.GetContainerNetwork(ctx)
 		if err != nil {
-			log.Errorf("Failed to write Network configuration to etcd: %v", err)
 			return err
 		}
+		if existing != network {
+			return ErrNetworkMismatch
+		}
 	}
 
 	key = path.Join(sub.etcdCfg.SubnetConfigPath, "SubnetLength")
 	data := strconv.FormatUint(uint64(subnetLength), 10)
-	_, err = sub.client().Create(key, data, 0)
-	if err != nil {
-		_, err = sub.client().Update(key, data, 0)
-		if err != nil {
-			log.Errorf("Failed to write Network configuration to etcd: %v", err)
-			return err
-		}
+	if _, err := sub.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, data)).
+		Commit(); err != nil {
+		log.Errorf("Failed to write Network configuration to etcd: %v", err)
+		return err
 	}
 	return nil
 }
 
-func (sub *EtcdSubnetRegistry) GetContainerNetwork() (string, error) {
+func (sub *EtcdSubnetRegistry) GetContainerNetwork(ctx context.Context) (string, error) {
 	key := path.Join(sub.etcdCfg.SubnetConfigPath, "ContainerNetwork")
-	resp, err := sub.client().Get(key, false, false)
+	resp, err := sub.cli.Get(ctx, key)
 	if err != nil {
-		return "", err
+		return "", classifyErr(err)
+	}
+	if len(resp.Kvs) == 0 {
+		return "", ErrNoNetworkConfig
 	}
-	return resp.Node.Value, err
+	return string(resp.Kvs[0].Value), nil
 }
 
-func (sub *EtcdSubnetRegistry) GetSubnetLength() (uint64, error) {
+func (sub *EtcdSubnetRegistry) GetSubnetLength(ctx context.Context) (uint64, error) {
 	key := path.Join(sub.etcdCfg.SubnetConfigPath, "SubnetLength")
-	resp, err := sub.client().Get(key, false, false)
-	if err == nil {
-		return strconv.ParseUint(resp.Node.Value, 10, 0)
+	resp, err := sub.cli.Get(ctx, key)
+	if err != nil {
+		return 0, classifyErr(err)
 	}
-	return 0, err
+	if len(resp.Kvs) == 0 {
+		return 0, ErrNoNetworkConfig
+	}
+	return strconv.ParseUint(string(resp.Kvs[0].Value), 10, 0)
 }
 
-func (sub *EtcdSubnetRegistry) CreateMinion(minion string, data string) error {
+func (sub *EtcdSubnetRegistry) CreateMinion(ctx context.Context, minion string, data string) error {
 	key := path.Join(sub.etcdCfg.MinionPath, minion)
-	_, err := sub.client().Get(key, false, false)
+	resp, err := sub.cli.Get(ctx, key)
 	if err != nil {
+		return classifyErr(err)
+	}
+	if len(resp.Kvs) == 0 {
 		// good, it does not exist, write it
-		_, err = sub.client().Create(key, data, 0)
-		if err != nil {
-			log.Errorf("Failed to write new subnet to etcd: %v", err)
-			return err
+		if _, err := sub.cli.Put(ctx, key, data); err != nil {
+			log.Errorf("Failed to write new minion to etcd: %v", err)
+			return classifyErr(err)
 		}
 	}
-
 	return nil
 }
 
-func (sub *EtcdSubnetRegistry) CreateSubnet(minion string, subnet *api.Subnet) error {
+func (sub *EtcdSubnetRegistry) CreateSubnet(ctx context.Context, minion string, subnet *api.Subnet, lease api.LeaseID) error {
 	subbytes, _ := json.Marshal(subnet)
 	data := string(subbytes)
 	log.Infof("Minion subnet structure: %s", data)
 	key := path.Join(sub.etcdCfg.SubnetPath, minion)
-	_, err := sub.client().Create(key, data, 0)
+
+	var opts []clientv3.OpOption
+	if lease != 0 {
+		opts = append(opts, clientv3.WithLease(clientv3.LeaseID(lease)))
+	}
+	if _, err := sub.cli.Put(ctx, key, data, opts...); err != nil {
+		log.Errorf("Failed to write new subnet to etcd: %v", err)
+		return err
+	}
+	return nil
+}
+
+// CompareAndCreateSubnet atomically creates the subnet entry for minion,
+// failing with ErrKeyExists if another writer already allocated one. Unlike
+// CreateSubnet, two callers racing on the same minion can never both
+// "succeed" and stomp each other's CIDR.
+func (sub *EtcdSubnetRegistry) CompareAndCreateSubnet(ctx context.Context, minion string, subnet *api.Subnet, lease api.LeaseID) error {
+	subbytes, _ := json.Marshal(subnet)
+	data := string(subbytes)
+	key := path.Join(sub.etcdCfg.SubnetPath, minion)
+
+	var opts []clientv3.OpOption
+	if lease != 0 {
+		opts = append(opts, clientv3.WithLease(clientv3.LeaseID(lease)))
+	}
+
+	resp, err := sub.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, data, opts...)).
+		Commit()
 	if err != nil {
-		_, err = sub.client().Update(key, data, 0)
-		if err != nil {
-			log.Errorf("Failed to write new subnet to etcd: %v", err)
-			return err
-		}
+		return classifyErr(err)
 	}
+	if !resp.Succeeded {
+		return ErrKeyExists
+	}
+	return nil
+}
 
+// CompareAndSwapSubnet atomically updates the subnet entry for minion,
+// failing with ErrCASFailed if its stored revision no longer matches
+// prevIndex (i.e. someone else wrote to it since the caller last read it).
+func (sub *EtcdSubnetRegistry) CompareAndSwapSubnet(ctx context.Context, minion string, subnet *api.Subnet, prevIndex uint64, lease api.LeaseID) error {
+	subbytes, _ := json.Marshal(subnet)
+	data := string(subbytes)
+	key := path.Join(sub.etcdCfg.SubnetPath, minion)
+
+	var opts []clientv3.OpOption
+	if lease != 0 {
+		opts = append(opts, clientv3.WithLease(clientv3.LeaseID(lease)))
+	}
+
+	resp, err := sub.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", int64(prevIndex))).
+		Then(clientv3.OpPut(key, data, opts...)).
+		Commit()
+	if err != nil {
+		return classifyErr(err)
+	}
+	if !resp.Succeeded {
+		return ErrCASFailed
+	}
 	return nil
 }
 
-func (sub *EtcdSubnetRegistry) WatchMinions(receiver chan *api.MinionEvent, stop chan bool) error {
-	var rev uint64
-	rev = 0
-	key := sub.etcdCfg.MinionPath
-	log.Infof("Watching %s for new minions.", key)
+// RegisterMinion registers minion under a lease with the given ttl. Unless
+// the caller renews the lease with KeepAliveMinion, the registration (and,
+// if CreateSubnet attached the same lease to the subnet entry, the subnet
+// allocation too) expires and etcd deletes the key on its own, which
+// WatchMinions/WatchSubnets surface as an ordinary Deleted event.
+func (sub *EtcdSubnetRegistry) RegisterMinion(ctx context.Context, minion, data string, ttl time.Duration) (api.LeaseID, error) {
+	leaseResp, err := sub.cli.Grant(ctx, int64(ttl.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+
+	key := path.Join(sub.etcdCfg.MinionPath, minion)
+	if _, err := sub.cli.Put(ctx, key, data, clientv3.WithLease(leaseResp.ID)); err != nil {
+		log.Errorf("Failed to register minion with etcd: %v", err)
+		return 0, err
+	}
+	return api.LeaseID(leaseResp.ID), nil
+}
+
+// KeepAliveMinion starts renewing lease in the background at the rate
+// clientv3 schedules internally (ttl/3) until ctx is cancelled.
+func (sub *EtcdSubnetRegistry) KeepAliveMinion(ctx context.Context, lease api.LeaseID) error {
+	ch, err := sub.cli.KeepAlive(ctx, clientv3.LeaseID(lease))
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for range ch {
+			// Drain keep-alive responses; nothing to do with them.
+		}
+	}()
+	return nil
+}
+
+// watchPrefix watches every key under key, calling handle for each event and
+// resuming from the last seen revision if the watch channel is torn down
+// (e.g. because of a transient connection error). It returns when ctx is
+// cancelled.
+func (sub *EtcdSubnetRegistry) watchPrefix(ctx context.Context, key string, handle func(*clientv3.Event)) error {
+	var rev int64
 	for {
-		resp, err := sub.watch(key, rev, stop)
-		if err != nil && err == etcd.ErrWatchStoppedByUser {
-			log.Infof("New subnet event error: %v", err)
-			return err
+		wch := sub.cli.Watch(ctx, key, clientv3.WithPrefix(), clientv3.WithRev(rev), clientv3.WithPrevKV())
+		var watchErr error
+		for wresp := range wch {
+			if err := wresp.Err(); err != nil {
+				watchErr = err
+				break
+			}
+			rev = wresp.Header.Revision + 1
+			for _, ev := range wresp.Events {
+				handle(ev)
+			}
 		}
-		if resp == nil || err != nil {
+
+		if watchErr != nil {
+			log.Warningf("Watch on %s failed: %v", key, watchErr)
+			if watchErr == rpctypes.ErrCompacted {
+				// rev has been compacted away; there's nothing to resume
+				// from, so start over from the current state of the tree.
+				resp, err := sub.cli.Get(ctx, key)
+				if err != nil {
+					log.Warningf("Failed to resync after compaction on %s: %v", key, err)
+				} else {
+					rev = resp.Header.Revision + 1
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Second):
+			}
 			continue
 		}
-		rev = resp.Node.ModifiedIndex + 1
-		log.Infof("Issuing a minion event: %v", resp)
-		minevent := newMinionEvent(resp.Action, resp.Node.Key, resp.Node.Value)
-		receiver <- minevent
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
 	}
 }
 
-func (sub *EtcdSubnetRegistry) watch(key string, rev uint64, stop chan bool) (*etcd.Response, error) {
-	rawResp, err := sub.client().RawWatch(key, rev, true, nil, stop)
+func (sub *EtcdSubnetRegistry) WatchMinions(ctx context.Context, receiver chan *api.MinionEvent) error {
+	key := sub.etcdCfg.MinionPath
+	log.Infof("Watching %s for new minions.", key)
+	return sub.watchPrefix(ctx, key, func(ev *clientv3.Event) {
+		if minevent := newMinionEvent(ev); minevent != nil {
+			log.Infof("Issuing a minion event: %v", minevent)
+			receiver <- minevent
+		}
+	})
+}
 
-	if err != nil {
-		if err == etcd.ErrWatchStoppedByUser {
-			return nil, err
-		} else {
-			log.Warningf("Temporary error while watching %s: %v\n", key, err)
-			time.Sleep(time.Second)
-			sub.resetClient()
-			return nil, nil
+func (sub *EtcdSubnetRegistry) WatchSubnets(ctx context.Context, receiver chan *api.SubnetEvent) error {
+	key := sub.etcdCfg.SubnetPath
+	log.Infof("Watching %s for subnet changes.", key)
+	return sub.watchPrefix(ctx, key, func(ev *clientv3.Event) {
+		if subevent := newSubnetEvent(ev); subevent != nil {
+			log.Infof("New subnet event: %v", subevent)
+			receiver <- subevent
 		}
-	}
+	})
+}
 
-	if len(rawResp.Body) == 0 {
-		// etcd timed out, go back but recreate the client as the underlying
-		// http transport gets hosed (http://code.google.com/p/go/issues/detail?id=8648)
-		sub.resetClient()
-		return nil, nil
+// snapshotDoc is the on-disk format produced by Snapshot and consumed by
+// Restore.
+type snapshotDoc struct {
+	Network      string                `json:"network"`
+	SubnetLength uint64                `json:"subnetLength"`
+	Minions      []string              `json:"minions"`
+	Subnets      map[string]api.Subnet `json:"subnets"`
+}
+
+// Snapshot dumps the network config, minions and subnet allocations as they
+// stood at a single etcd revision, so the result can't straddle a
+// concurrent write.
+func (sub *EtcdSubnetRegistry) Snapshot(ctx context.Context, w io.Writer) error {
+	networkKey := path.Join(sub.etcdCfg.SubnetConfigPath, "ContainerNetwork")
+	lengthKey := path.Join(sub.etcdCfg.SubnetConfigPath, "SubnetLength")
+
+	resp, err := sub.cli.Txn(ctx).Then(
+		clientv3.OpGet(networkKey),
+		clientv3.OpGet(lengthKey),
+		clientv3.OpGet(sub.etcdCfg.MinionPath, clientv3.WithPrefix()),
+		clientv3.OpGet(sub.etcdCfg.SubnetPath, clientv3.WithPrefix()),
+	).Commit()
+	if err != nil {
+		return classifyErr(err)
 	}
 
-	return rawResp.Unmarshal()
-}
+	networkResp := resp.Responses[0].GetResponseRange()
+	lengthResp := resp.Responses[1].GetResponseRange()
+	minionsResp := resp.Responses[2].GetResponseRange()
+	subnetsResp := resp.Responses[3].GetResponseRange()
 
-func (sub *EtcdSubnetRegistry) WatchSubnets(receiver chan *api.SubnetEvent, stop chan bool) error {
-	for {
-		var rev uint64
-		rev = 0
-		key := sub.etcdCfg.SubnetPath
-		resp, err := sub.watch(key, rev, stop)
-		if resp == nil && err == nil {
-			continue
-		}
-		rev = resp.Node.ModifiedIndex + 1
-		if err != nil && err == etcd.ErrWatchStoppedByUser {
-			log.Infof("New subnet event error: %v", err)
+	if len(networkResp.Kvs) == 0 {
+		return ErrNoNetworkConfig
+	}
+
+	snap := snapshotDoc{
+		Network: string(networkResp.Kvs[0].Value),
+		Minions: make([]string, 0, len(minionsResp.Kvs)),
+		Subnets: make(map[string]api.Subnet, len(subnetsResp.Kvs)),
+	}
+	if len(lengthResp.Kvs) > 0 {
+		snap.SubnetLength, err = strconv.ParseUint(string(lengthResp.Kvs[0].Value), 10, 0)
+		if err != nil {
 			return err
 		}
-		subevent := newSubnetEvent(resp)
-		log.Infof("New subnet event: %v, %v", subevent, resp)
-		receiver <- subevent
 	}
-}
+	for _, kv := range minionsResp.Kvs {
+		_, minion := path.Split(string(kv.Key))
+		snap.Minions = append(snap.Minions, minion)
+	}
+	for _, kv := range subnetsResp.Kvs {
+		_, minion := path.Split(string(kv.Key))
+		var s api.Subnet
+		if err := json.Unmarshal(kv.Value, &s); err != nil {
+			log.Errorf("Error unmarshalling subnet for minion %s while snapshotting: %v", minion, err)
+			continue
+		}
+		snap.Subnets[minion] = s
+	}
 
-func (sub *EtcdSubnetRegistry) client() *etcd.Client {
-	sub.mux.Lock()
-	defer sub.mux.Unlock()
-	return sub.cli
+	return json.NewEncoder(w).Encode(&snap)
 }
 
-func (sub *EtcdSubnetRegistry) resetClient() {
-	sub.mux.Lock()
-	defer sub.mux.Unlock()
+// restoreBatchSize bounds how many Ops Restore puts into a single etcd
+// transaction. etcd rejects transactions over its --max-txn-ops limit
+// (128 by default); staying comfortably under that means Restore still
+// works against a default-configured cluster regardless of how many
+// minions/subnets are in the snapshot.
+const restoreBatchSize = 100
+
+// Restore replays a Snapshot dump into etcd. The wipe of any pre-existing
+// data (when force is set) and the write of the network config each happen
+// as their own small transaction, and the minion/subnet puts are batched
+// across as many transactions of up to restoreBatchSize Ops as needed to
+// stay under etcd's --max-txn-ops limit. This means Restore is no longer
+// all-or-nothing for large snapshots: a failure partway through leaves
+// whichever batches already committed in place rather than rolling
+// everything back. Callers that need strict atomicity should restore into
+// a fresh registry and swap it in, rather than restoring in place.
+// It refuses to touch a registry that already has subnet allocations
+// unless force is set, in which case the existing network config and
+// subnets are wiped first.
+func (sub *EtcdSubnetRegistry) Restore(ctx context.Context, r io.Reader, force bool) error {
+	var snap snapshotDoc
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return err
+	}
 
-	var err error
-	sub.cli, err = newEtcdClient(sub.etcdCfg)
+	existing, err := sub.cli.Get(ctx, sub.etcdCfg.SubnetPath, clientv3.WithPrefix(), clientv3.WithCountOnly())
 	if err != nil {
-		panic(fmt.Errorf("resetClient: error recreating etcd client: %v", err))
+		return classifyErr(err)
+	}
+	if existing.Count > 0 && !force {
+		return fmt.Errorf("refusing to restore over %d existing subnet(s); pass force to overwrite", existing.Count)
+	}
+
+	networkKey := path.Join(sub.etcdCfg.SubnetConfigPath, "ContainerNetwork")
+	lengthKey := path.Join(sub.etcdCfg.SubnetConfigPath, "SubnetLength")
+
+	if existing.Count > 0 {
+		if _, err := sub.cli.Txn(ctx).Then(
+			clientv3.OpDelete(sub.etcdCfg.SubnetPath, clientv3.WithPrefix()),
+			clientv3.OpDelete(networkKey),
+			clientv3.OpDelete(lengthKey),
+		).Commit(); err != nil {
+			return classifyErr(err)
+		}
+	}
+
+	if _, err := sub.cli.Txn(ctx).Then(
+		clientv3.OpPut(networkKey, snap.Network),
+		clientv3.OpPut(lengthKey, strconv.FormatUint(snap.SubnetLength, 10)),
+	).Commit(); err != nil {
+		return classifyErr(err)
+	}
+
+	var ops []clientv3.Op
+	for _, minion := range snap.Minions {
+		ops = append(ops, clientv3.OpPut(path.Join(sub.etcdCfg.MinionPath, minion), ""))
 	}
+	for minion, s := range snap.Subnets {
+		data, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, clientv3.OpPut(path.Join(sub.etcdCfg.SubnetPath, minion), string(data)))
+	}
+
+	for len(ops) > 0 {
+		n := restoreBatchSize
+		if n > len(ops) {
+			n = len(ops)
+		}
+		if _, err := sub.cli.Txn(ctx).Then(ops[:n]...).Commit(); err != nil {
+			return classifyErr(err)
+		}
+		ops = ops[n:]
+	}
+	return nil
 }
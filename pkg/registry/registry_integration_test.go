@@ -0,0 +1,224 @@
+// +build integration
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/integration"
+
+	"github.com/openshift/openshift-sdn/pkg/api"
+)
+
+// These tests spin up a real embedded etcd cluster (go.etcd.io/etcd/integration)
+// and exercise the behaviors that are specific to EtcdSubnetRegistry and
+// cannot be covered by bolt_test.go: CAS against real revisions, lease
+// reclamation, error classification against a real client, watch resume
+// across a reconnect, snapshot/restore, and leader election. They are
+// gated behind the "integration" build tag because they are slower and
+// noisier than the rest of the suite: run with
+// `go test -tags integration ./pkg/registry/...`.
+
+func newTestEtcdRegistry(t *testing.T, clus *integration.ClusterV3) *EtcdSubnetRegistry {
+	t.Helper()
+	return &EtcdSubnetRegistry{
+		cli: clus.RandClient(),
+		etcdCfg: &EtcdConfig{
+			SubnetPath:       "/openshift.com/network/subnets",
+			SubnetConfigPath: "/openshift.com/network/config",
+			MinionPath:       "/openshift.com/network/minions",
+		},
+	}
+}
+
+func TestEtcdCompareAndSwapSubnetCAS(t *testing.T) {
+	clus := integration.NewClusterV3(t, &integration.ClusterConfig{Size: 1})
+	defer clus.Terminate(t)
+
+	reg := newTestEtcdRegistry(t, clus)
+	ctx := context.Background()
+
+	sub := &api.Subnet{Sub: "10.1.1.0/24"}
+	if err := reg.CreateSubnet(ctx, "minion1", sub, 0); err != nil {
+		t.Fatalf("CreateSubnet: %v", err)
+	}
+	_, rev, err := reg.GetSubnet(ctx, "minion1")
+	if err != nil {
+		t.Fatalf("GetSubnet: %v", err)
+	}
+
+	updated := &api.Subnet{Sub: "10.1.1.0/24", Data: "updated"}
+	if err := reg.CompareAndSwapSubnet(ctx, "minion1", updated, rev, 0); err != nil {
+		t.Fatalf("CompareAndSwapSubnet at current rev: %v", err)
+	}
+
+	// rev is now stale; a second swap against it must fail rather than
+	// silently clobbering whoever updated it in between.
+	if err := reg.CompareAndSwapSubnet(ctx, "minion1", updated, rev, 0); !errors.Is(err, ErrCASFailed) {
+		t.Fatalf("CompareAndSwapSubnet at stale rev err = %v, want ErrCASFailed", err)
+	}
+}
+
+func TestEtcdRegisterMinionLeaseExpiry(t *testing.T) {
+	clus := integration.NewClusterV3(t, &integration.ClusterConfig{Size: 1})
+	defer clus.Terminate(t)
+
+	reg := newTestEtcdRegistry(t, clus)
+	ctx := context.Background()
+
+	lease, err := reg.RegisterMinion(ctx, "minion1", "", time.Second)
+	if err != nil {
+		t.Fatalf("RegisterMinion: %v", err)
+	}
+
+	minions, err := reg.GetMinions(ctx)
+	if err != nil || len(*minions) != 1 {
+		t.Fatalf("GetMinions = (%v, %v), want exactly minion1", minions, err)
+	}
+
+	// Without a KeepAliveMinion renewal the lease expires on its own and
+	// etcd reclaims the minion entry.
+	time.Sleep(2 * time.Second)
+
+	minions, err = reg.GetMinions(ctx)
+	if err != nil || len(*minions) != 0 {
+		t.Fatalf("GetMinions after lease expiry = (%v, %v), want none", minions, err)
+	}
+	_ = lease
+}
+
+func TestEtcdGetSubnetNotFoundSentinel(t *testing.T) {
+	clus := integration.NewClusterV3(t, &integration.ClusterConfig{Size: 1})
+	defer clus.Terminate(t)
+
+	reg := newTestEtcdRegistry(t, clus)
+	ctx := context.Background()
+
+	if _, _, err := reg.GetSubnet(ctx, "missing"); !errors.Is(err, ErrSubnetNotFound) {
+		t.Fatalf("GetSubnet(missing) err = %v, want ErrSubnetNotFound", err)
+	}
+}
+
+func TestEtcdWatchSubnetsResumesAfterDisconnect(t *testing.T) {
+	clus := integration.NewClusterV3(t, &integration.ClusterConfig{Size: 1})
+	defer clus.Terminate(t)
+
+	reg := newTestEtcdRegistry(t, clus)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	receiver := make(chan *api.SubnetEvent, 1)
+	go reg.WatchSubnets(ctx, receiver)
+	time.Sleep(100 * time.Millisecond)
+
+	// Knock the watch's member down and back up; watchPrefix must reconnect
+	// and resume delivering events rather than hanging forever.
+	clus.Members[0].Stop(t)
+	clus.Members[0].Restart(t)
+
+	sub := &api.Subnet{Sub: "10.1.1.0/24"}
+	if err := reg.CreateSubnet(ctx, "minion1", sub, 0); err != nil {
+		t.Fatalf("CreateSubnet: %v", err)
+	}
+
+	select {
+	case ev := <-receiver:
+		if ev.Type != api.Added || ev.Minion != "minion1" {
+			t.Fatalf("unexpected subnet event after reconnect: %+v", ev)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for subnet event after watch reconnect")
+	}
+}
+
+func TestEtcdSnapshotRestoreRoundTrip(t *testing.T) {
+	clus := integration.NewClusterV3(t, &integration.ClusterConfig{Size: 1})
+	defer clus.Terminate(t)
+
+	src := newTestEtcdRegistry(t, clus)
+	ctx := context.Background()
+
+	if err := src.WriteNetworkConfig(ctx, "10.1.0.0/16", 24); err != nil {
+		t.Fatalf("WriteNetworkConfig: %v", err)
+	}
+	if err := src.CreateMinion(ctx, "minion1", ""); err != nil {
+		t.Fatalf("CreateMinion: %v", err)
+	}
+	if err := src.CreateSubnet(ctx, "minion1", &api.Subnet{Sub: "10.1.1.0/24"}, 0); err != nil {
+		t.Fatalf("CreateSubnet: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := src.Snapshot(ctx, &buf); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	dst := newTestEtcdRegistry(t, clus)
+	dst.etcdCfg.SubnetPath = "/restored/network/subnets"
+	dst.etcdCfg.SubnetConfigPath = "/restored/network/config"
+	dst.etcdCfg.MinionPath = "/restored/network/minions"
+	if err := dst.Restore(ctx, bytes.NewReader(buf.Bytes()), false); err != nil {
+		t.Fatalf("Restore into empty registry: %v", err)
+	}
+
+	network, err := dst.GetContainerNetwork(ctx)
+	if err != nil || network != "10.1.0.0/16" {
+		t.Fatalf("GetContainerNetwork = (%q, %v), want 10.1.0.0/16", network, err)
+	}
+	sub, _, err := dst.GetSubnet(ctx, "minion1")
+	if err != nil || sub.Sub != "10.1.1.0/24" {
+		t.Fatalf("GetSubnet = (%+v, %v), want 10.1.1.0/24", sub, err)
+	}
+}
+
+func TestEtcdLeaderElectionHandoff(t *testing.T) {
+	clus := integration.NewClusterV3(t, &integration.ClusterConfig{Size: 1})
+	defer clus.Terminate(t)
+
+	cfg := &EtcdConfig{SubnetConfigPath: "/openshift.com/network/config"}
+
+	acquired := make(chan struct{}, 2)
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		elector := NewLeaderElector(clus.RandClient(), cfg, time.Second)
+		firstErr <- elector.RunAsLeader(ctx1, func(leaderCtx context.Context) {
+			acquired <- struct{}{}
+			<-leaderCtx.Done()
+		})
+	}()
+
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first elector never acquired leadership")
+	}
+
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	go func() {
+		elector := NewLeaderElector(clus.RandClient(), cfg, time.Second)
+		elector.RunAsLeader(ctx2, func(leaderCtx context.Context) {
+			acquired <- struct{}{}
+			<-leaderCtx.Done()
+		})
+	}()
+
+	// Cancelling the first elector's context must release its session so
+	// the second elector, which has been campaigning in the background,
+	// takes over.
+	cancel1()
+	if err := <-firstErr; err != ctx1.Err() {
+		t.Fatalf("first elector RunAsLeader err = %v, want %v", err, ctx1.Err())
+	}
+
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("second elector never took over leadership")
+	}
+}